@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// chunkFrameMagic identifies a -checksum archive stream: a sequence of
+// length-prefixed, CRC32C-terminated chunks rather than raw archive bytes,
+// so corruption can be detected and, with -continue-on-error, skipped at
+// chunk granularity instead of panicking on the first bad binary.Read.
+//
+// -continue-on-error only recovers cleanly when -checksum is used without
+// -z. archiveWriter calls FlushBoundary after every record, and chunkWriter
+// only actually flushes there, so every chunk boundary is also a record
+// boundary: dropping one corrupt chunk loses exactly the records it
+// contained and the next chunk picks back up at a path-length field, not
+// mid-record. When -z is also set, chunks instead carry an arbitrary slice
+// of the compressor's own bitstream, unrelated to record boundaries;
+// skipping one desyncs the decompressor for everything after it, so on a
+// compressed archive -continue-on-error still generally surfaces as a
+// decode error rather than a clean per-record skip.
+var chunkFrameMagic = [4]byte{'F', 'A', 'C', 'K'}
+
+// chunkPayloadSize is the target size of each chunk's payload; the final
+// chunk of a stream is whatever is left over and may be smaller.
+const chunkPayloadSize = 1 << 20 // 1 MiB
+
+// maxChunkPayloadSize bounds the length field read from a chunk header. A
+// corrupted length is the one kind of damage a payload CRC can't catch on
+// its own; rather than trust an arbitrarily large value and try to read
+// that many bytes, a length past this bound is treated as unrecoverable
+// corruption immediately; resynchronizing past it isn't possible since its
+// own length can't be trusted.
+const maxChunkPayloadSize = 16 << 20 // 16 MiB
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// boundaryFlusher lets an upper layer that knows where its own logical
+// records end, but writes through an arbitrary io.Writer, tell an
+// implementation like chunkWriter "a complete record ends here" -- the one
+// place it's safe to cut a chunk boundary without later breaking a reader's
+// ability to resynchronize after skipping a corrupt one.
+type boundaryFlusher interface {
+	FlushBoundary() error
+}
+
+// chunkWriter frames everything written through it into chunkPayloadSize
+// chunks, each written as {length uint32, payload, crc32c uint32}. It
+// writes chunkFrameMagic immediately so a reader can tell a checksummed
+// archive from a raw one by its first four bytes.
+type chunkWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newChunkWriter(w io.Writer) (*chunkWriter, error) {
+	if _, err := w.Write(chunkFrameMagic[:]); err != nil {
+		return nil, err
+	}
+	return &chunkWriter{w: w, buf: make([]byte, 0, chunkPayloadSize)}, nil
+}
+
+// Write only buffers; it never flushes on its own, even once c.buf grows
+// past chunkPayloadSize. Flushing mid-write would frame a chunk boundary
+// in the middle of whatever the caller is writing, which for archiveWriter
+// is the middle of an archive record -- exactly what defeats
+// -continue-on-error's resync. Call FlushBoundary once the caller knows a
+// record has ended instead.
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	return len(p), nil
+}
+
+// FlushBoundary flushes the buffered bytes as one chunk if they've reached
+// chunkPayloadSize. Called by archiveWriter once a complete record has been
+// written, so a chunk is only ever cut at a point a reader can resynchronize
+// to; a record shorter than chunkPayloadSize is simply carried over into
+// the same chunk as the records after it.
+func (c *chunkWriter) FlushBoundary() error {
+	if len(c.buf) < chunkPayloadSize {
+		return nil
+	}
+	return c.flush()
+}
+
+// flush writes out whatever is buffered as one (possibly short) chunk.
+func (c *chunkWriter) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	if err := binary.Write(c.w, binary.BigEndian, uint32(len(c.buf))); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(c.buf); err != nil {
+		return err
+	}
+	if err := binary.Write(c.w, binary.BigEndian, crc32.Checksum(c.buf, crc32cTable)); err != nil {
+		return err
+	}
+	c.buf = c.buf[:0]
+	return nil
+}
+
+// Close flushes the final, possibly partial, chunk. It does not close the
+// underlying writer.
+func (c *chunkWriter) Close() error {
+	return c.flush()
+}
+
+// chunkReader reverses chunkWriter: it reads and verifies one chunk at a
+// time, serving its payload to callers, and reads the next chunk once the
+// current one is exhausted.
+type chunkReader struct {
+	r               io.Reader
+	continueOnError bool
+	buf             []byte
+	pos             int
+	err             error
+	skipped         int
+}
+
+// newChunkReader consumes and verifies chunkFrameMagic from r and returns a
+// reader over the dechunked payload stream.
+func newChunkReader(r io.Reader, continueOnError bool) (*chunkReader, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != chunkFrameMagic {
+		return nil, fmt.Errorf("not a chunked archive stream")
+	}
+	return &chunkReader{r: r, continueOnError: continueOnError}, nil
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for c.pos >= len(c.buf) {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if err := c.fill(); err != nil {
+			c.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf[c.pos:])
+	c.pos += n
+	return n, nil
+}
+
+// fill reads and verifies the next chunk into c.buf. When continueOnError
+// is set, a chunk whose CRC32C doesn't match is logged and skipped so the
+// stream resynchronizes at the next chunk boundary instead of aborting;
+// otherwise the first mismatch is returned as an error.
+func (c *chunkReader) fill() error {
+	for {
+		var length uint32
+		if err := binary.Read(c.r, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if length > maxChunkPayloadSize {
+			return fmt.Errorf("chunk length %d exceeds maximum %d; archive is corrupt", length, maxChunkPayloadSize)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+
+		var crc uint32
+		if err := binary.Read(c.r, binary.BigEndian, &crc); err != nil {
+			return err
+		}
+
+		if crc32.Checksum(payload, crc32cTable) != crc {
+			if !c.continueOnError {
+				return fmt.Errorf("chunk checksum mismatch; archive is corrupt")
+			}
+			logger.Println("chunk checksum mismatch; skipping corrupt chunk and resynchronizing")
+			c.skipped++
+			continue
+		}
+
+		c.buf = payload
+		c.pos = 0
+		return nil
+	}
+}
+
+// skipCount returns the number of corrupt chunks dropped so far under
+// -continue-on-error. archiveReader polls this to notice when a skip may
+// have swallowed a file's remaining data blocks or its endOfFileFlag, so it
+// can abandon that file's extraction instead of leaving it blocked forever.
+func (c *chunkReader) skipCount() int {
+	return c.skipped
+}
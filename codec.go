@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// codec describes one pluggable -z compression option: how to recognize
+// its stream on read (magic, the first two bytes it writes) and how to
+// wrap a writer or reader with it.
+type codec struct {
+	name      string
+	magic     [2]byte
+	newWriter func(io.Writer) (io.WriteCloser, error)
+	newReader func(io.Reader) (io.ReadCloser, error)
+}
+
+// registeredCodecs holds every -z option this build can actually perform.
+var registeredCodecs = map[string]*codec{
+	"gzip": {
+		name:  "gzip",
+		magic: [2]byte{0x1f, 0x8b},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+// unimplementedCodecs lists -z names this build recognizes as valid
+// choices but cannot perform, because each relies on a dependency this
+// module does not vendor. Rejecting them by name gives a clear error
+// instead of an opaque "unknown -z codec".
+var unimplementedCodecs = map[string]string{
+	"zstd": "zstd support requires vendoring github.com/klauspost/compress/zstd, which this module does not depend on",
+	"lz4":  "lz4 support requires vendoring github.com/pierrec/lz4, which this module does not depend on",
+}
+
+// codecNames lists every -z value accepted by the flag parser, for the
+// flag's usage text, in a stable order (registeredCodecs/unimplementedCodecs
+// are maps, so their own iteration order isn't).
+func codecNames() []string {
+	var names []string
+	for name := range registeredCodecs {
+		names = append(names, name)
+	}
+	for name := range unimplementedCodecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{"none"}, names...)
+}
+
+// codecForMagic returns the registered codec whose magic matches the first
+// two bytes of an archive stream, or nil if none does.
+func codecForMagic(first2 [2]byte) *codec {
+	for _, c := range registeredCodecs {
+		if c.magic == first2 {
+			return c
+		}
+	}
+	return nil
+}
+
+// archiveInput bundles the byte stream that archiveReader/listArchive
+// decode records from with, when it's available, the underlying *os.File
+// so the table-of-contents direct-seek optimizations can Seek it. seekFile
+// is nil whenever that isn't safe: a pipe, or a stream wrapped in
+// compression or chunk framing, whose byte offsets no longer correspond to
+// positions in the underlying file. chunkSkipCount is set only when the
+// stream is framed into checksummed chunks; archiveReader polls it to
+// notice a -continue-on-error skip that may have swallowed a file's
+// remaining records.
+type archiveInput struct {
+	r              io.Reader
+	seekFile       *os.File
+	chunkSkipCount func() int
+}
+
+// openArchiveInput inspects the first bytes of file to detect whether it
+// was written with -checksum and/or -z, and builds the dechunking and
+// decompressing reader chain implied by what it finds. A plain archive
+// with neither wrapper keeps seekFile set so the table-of-contents
+// optimizations in archiveReader/listArchive still apply.
+func openArchiveInput(file *os.File, continueOnError bool) archiveInput {
+	regular := false
+	if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+		regular = true
+	}
+
+	br := bufio.NewReader(file)
+	peeked, err := br.Peek(4)
+	if err != nil {
+		// Too short to carry any magic; let the existing magic check in
+		// archiveReader/listArchive produce the "unrecognized format" error.
+		return archiveInput{r: br}
+	}
+	var magic [4]byte
+	copy(magic[:], peeked)
+
+	if magic == archiveMagic {
+		if regular {
+			// Nothing was buffered past what was peeked that we need: seek
+			// the file back to the start and read it directly from here on,
+			// so later Seeks for the table of contents land at the right
+			// byte offsets.
+			if _, err := file.Seek(0, io.SeekStart); err == nil {
+				return archiveInput{r: file, seekFile: file}
+			}
+		}
+		return archiveInput{r: br}
+	}
+
+	r, chunkSkipCount := wrapContainer(br, magic, continueOnError)
+	return archiveInput{r: r, chunkSkipCount: chunkSkipCount}
+}
+
+// wrapContainer builds the reader chain implied by magic, the first four
+// bytes already peeked (but not consumed) from r: chunk framing first, if
+// present, since it's the outermost layer written to the file, then
+// compression, since -checksum frames compress-then-checksum on write
+// ("verify-then-decompress" on read, in the same order reversed). The
+// second return value is the chunk reader's skip counter, or nil if the
+// stream isn't chunk-framed.
+func wrapContainer(r io.Reader, magic [4]byte, continueOnError bool) (io.Reader, func() int) {
+	if magic == chunkFrameMagic {
+		cr, err := newChunkReader(r, continueOnError)
+		if err != nil {
+			logger.Panicln("Archive read error:", err.Error())
+		}
+
+		inner := bufio.NewReader(cr)
+		if peeked, err := inner.Peek(4); err == nil {
+			var innerMagic [2]byte
+			copy(innerMagic[:], peeked[:2])
+			if c := codecForMagic(innerMagic); c != nil {
+				rc, err := c.newReader(inner)
+				if err != nil {
+					logger.Panicln("Archive read error:", err.Error())
+				}
+				return rc, cr.skipCount
+			}
+		}
+		return inner, cr.skipCount
+	}
+
+	var first2 [2]byte
+	copy(first2[:], magic[:2])
+	if c := codecForMagic(first2); c != nil {
+		rc, err := c.newReader(r)
+		if err != nil {
+			logger.Panicln("Archive read error:", err.Error())
+		}
+		return rc, nil
+	}
+
+	return r, nil
+}
+
+// flusher is implemented by codec writers (e.g. gzip.Writer) that can push
+// their buffered-but-not-yet-written compressed bytes out without ending
+// the stream.
+type flusher interface {
+	Flush() error
+}
+
+// codecBoundaryFlusher adapts a codec writer sitting between archiveWriter
+// and chunkW so FlushBoundary calls still reach chunkW. A codec buffers
+// compressed bytes internally and only hands them to chunkW on Flush or
+// Close, so without forcing that first, chunkW would never see enough
+// buffered bytes to cut a chunk and a -z -checksum archive would stay
+// entirely unflushed in memory until the archive closes.
+type codecBoundaryFlusher struct {
+	io.WriteCloser
+	chunkW *chunkWriter
+}
+
+func (c *codecBoundaryFlusher) FlushBoundary() error {
+	if f, ok := c.WriteCloser.(flusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	return c.chunkW.FlushBoundary()
+}
+
+// newArchiveOutput builds the write-side pipeline requested by zName and
+// checksum around base (the destination file), in compress-then-checksum
+// order: archiveWriter's bytes are compressed first, and the compressed
+// bytes are what gets framed into checksummed chunks, so the layer closest
+// to archiveWriter is the codec and the layer closest to base is the chunk
+// framer. The returned close func must be called, in place of closing base
+// directly, before base itself is closed: it closes every wrapper in the
+// reverse order, innermost (the codec) first, so a compressor's trailer is
+// flushed into the chunk framer before the framer flushes its own final,
+// partial chunk into base.
+func newArchiveOutput(base io.Writer, zName string, checksum bool) (io.Writer, func() error, error) {
+	w := base
+	var closers []io.Closer
+	var chunkW *chunkWriter
+
+	if checksum {
+		cw, err := newChunkWriter(w)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, cw)
+		chunkW = cw
+		w = cw
+	}
+
+	if zName != "" && zName != "none" {
+		c, ok := registeredCodecs[zName]
+		if !ok {
+			if reason, known := unimplementedCodecs[zName]; known {
+				return nil, nil, fmt.Errorf("-z %s: %s", zName, reason)
+			}
+			return nil, nil, fmt.Errorf("-z %s: unrecognized codec", zName)
+		}
+		cw, err := c.newWriter(w)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, cw)
+		w = cw
+
+		// With both -z and -checksum, chunkW sits behind the codec rather
+		// than being w itself, so archiveWriter's boundaryFlusher type
+		// assertion on w would miss it entirely and every compressed byte
+		// would sit buffered in chunkW, never flushed, until Close: wrap w
+		// in an adapter that forwards FlushBoundary through the codec.
+		if chunkW != nil {
+			w = &codecBoundaryFlusher{WriteCloser: cw, chunkW: chunkW}
+		}
+	}
+
+	return w, func() error {
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i].Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
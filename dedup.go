@@ -0,0 +1,194 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"io"
+	"math"
+)
+
+// blockHash identifies a data block by content. 16 bytes (half of a
+// SHA-256 digest) keeps the odds of an accidental collision astronomically
+// low while halving the memory cost of tracking every hash seen so far,
+// which matters since that tracking lives entirely in RAM.
+type blockHash [16]byte
+
+const blockDefFlag byte = 1 << 3
+const blockRefFlag byte = 1 << 4
+
+var dedupMode bool
+var dedupWindow int
+
+func hashBlock(buffer []byte) blockHash {
+	digest := sha256.Sum256(buffer)
+	var h blockHash
+	copy(h[:], digest[:len(h)])
+	return h
+}
+
+// dedupStage sits between fileReader and archiveWriter. It hashes every
+// data block and rewrites it to a blockDef the first time a hash is seen
+// and a blockRef (hash only, no bytes) on every subsequent occurrence, so
+// that duplicate content -- repeated files, or repeated regions across
+// files such as VM images or vendored dependency trees -- is stored at
+// most once. startOfFile and endOfFile blocks pass through unchanged.
+//
+// Recently-seen hashes are tracked in an LRU bounded by window so memory
+// stays flat on large archives; once a hash falls out of the window,
+// matching content is re-emitted as a fresh def rather than a ref. A
+// window of 0 tracks every hash for the life of the archive, which
+// maximizes dedup at the cost of unbounded RAM (16 bytes per distinct
+// block seen).
+func dedupStage(input <-chan block, output chan<- block, window int) {
+	seen := newHashLRU(window)
+
+	for b := range input {
+		if b.startOfFile || b.endOfFile {
+			output <- b
+			continue
+		}
+
+		hash := hashBlock(b.buffer[:b.numBytes])
+		if seen.seenOrAdd(hash) {
+			output <- block{filePath: b.filePath, offset: b.offset, blockRef: true, hash: hash}
+		} else {
+			output <- block{filePath: b.filePath, offset: b.offset, blockDef: true, hash: hash, numBytes: b.numBytes, buffer: b.buffer}
+		}
+	}
+
+	close(output)
+}
+
+// hashLRU records which block hashes have already been emitted as a def,
+// evicting the least-recently-seen hash once capacity is exceeded. A zero
+// capacity disables eviction entirely.
+type hashLRU struct {
+	capacity int
+	ll       *list.List
+	index    map[blockHash]*list.Element
+}
+
+func newHashLRU(capacity int) *hashLRU {
+	return &hashLRU{capacity: capacity, ll: list.New(), index: make(map[blockHash]*list.Element)}
+}
+
+// seenOrAdd reports whether hash has already been recorded and, if not,
+// records it as the most-recently-seen entry.
+func (l *hashLRU) seenOrAdd(hash blockHash) bool {
+	if el, ok := l.index[hash]; ok {
+		l.ll.MoveToFront(el)
+		return true
+	}
+
+	l.index[hash] = l.ll.PushFront(hash)
+
+	if l.capacity > 0 {
+		for l.ll.Len() > l.capacity {
+			back := l.ll.Back()
+			l.ll.Remove(back)
+			delete(l.index, back.Value.(blockHash))
+		}
+	}
+
+	return false
+}
+
+// gearTable holds one pseudo-random 64-bit constant per byte value, used by
+// contentDefinedChunker's rolling hash. The values only need to be well
+// distributed; they don't need to match any external chunking scheme, so
+// they're derived from a fixed seed with splitmix64 rather than hand-picked.
+var gearTable = buildGearTable()
+
+func buildGearTable() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// contentDefinedChunker splits a stream into variable-length chunks using a
+// gear hash: a byte is a boundary candidate once the low bits of a rolling
+// hash over the bytes seen so far are all zero. Because the boundary is
+// anchored to local content instead of a fixed byte offset, inserting or
+// deleting bytes earlier in a file only perturbs the chunk immediately
+// around the edit -- every later chunk still lands on the same boundaries
+// it would have without the edit, so identical regions that recur (a
+// repeated file, a shifted-but-unchanged block of a VM image) still hash
+// and dedup identically. Fixed-offset chunking loses that: a single-byte
+// insertion shifts every subsequent block's boundary and so its hash.
+type contentDefinedChunker struct {
+	r        io.Reader
+	min, max int
+	mask     uint64
+	eof      bool
+}
+
+// newContentDefinedChunker returns a chunker over r targeting an average
+// chunk size of target, bounded to [target/4, target*4] so a degenerate
+// run of bytes (e.g. a long stretch of zeroes) can't produce a pathologically
+// small or unbounded chunk.
+func newContentDefinedChunker(r io.Reader, target uint16) *contentDefinedChunker {
+	t := int(target)
+	max := t * 4
+	if max <= 0 || max > math.MaxUint16 {
+		max = math.MaxUint16
+	}
+	min := t / 4
+	if min <= 0 {
+		min = 1
+	}
+	return &contentDefinedChunker{r: r, min: min, max: max, mask: cdcMask(target)}
+}
+
+// cdcMask returns a mask whose k zeroed low bits make a uniformly
+// distributed rolling hash clear it with probability 1/2^k; k is chosen so
+// 2^k is the closest power of two to target, giving an average chunk size
+// of roughly target bytes.
+func cdcMask(target uint16) uint64 {
+	bits := uint(0)
+	for (uint64(1) << bits) < uint64(target) {
+		bits++
+	}
+	return 1<<bits - 1
+}
+
+// next reads and returns the next content-defined chunk, or io.EOF once the
+// underlying reader is exhausted with no further bytes to return.
+func (c *contentDefinedChunker) next() ([]byte, error) {
+	if c.eof {
+		return nil, io.EOF
+	}
+
+	buf := make([]byte, 0, c.min)
+	one := make([]byte, 1)
+	var hash uint64
+
+	for len(buf) < c.max {
+		n, err := c.r.Read(one)
+		if n == 1 {
+			buf = append(buf, one[0])
+			hash = (hash << 1) + gearTable[one[0]]
+			if len(buf) >= c.min && hash&c.mask == 0 {
+				return buf, nil
+			}
+		}
+		if err == io.EOF {
+			c.eof = true
+			if len(buf) == 0 {
+				return nil, io.EOF
+			}
+			return buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
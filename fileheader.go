@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fileHeader carries the per-file metadata that is written to the archive
+// immediately after the startOfFileFlag, before any data blocks. It is
+// enough information to recreate the node on extract: its type (via the
+// type bits in mode), permissions, ownership, modification time, and,
+// for symlinks and hardlinks, the link target.
+type fileHeader struct {
+	mode           uint32
+	mtime          int64 // UnixNano
+	uid            uint32
+	gid            uint32
+	size           uint64
+	linkTarget     string // symlink target; empty if not a symlink
+	hardlinkTarget string // archive path of a previously-seen file sharing this inode; empty otherwise
+}
+
+func writeFileHeader(output io.Writer, header fileHeader) error {
+	if err := binary.Write(output, binary.BigEndian, header.mode); err != nil {
+		return err
+	}
+	if err := binary.Write(output, binary.BigEndian, header.mtime); err != nil {
+		return err
+	}
+	if err := binary.Write(output, binary.BigEndian, header.uid); err != nil {
+		return err
+	}
+	if err := binary.Write(output, binary.BigEndian, header.gid); err != nil {
+		return err
+	}
+	if err := binary.Write(output, binary.BigEndian, header.size); err != nil {
+		return err
+	}
+	if err := writeHeaderString(output, header.linkTarget); err != nil {
+		return err
+	}
+	return writeHeaderString(output, header.hardlinkTarget)
+}
+
+func readFileHeader(input io.Reader) (fileHeader, error) {
+	var header fileHeader
+	if err := binary.Read(input, binary.BigEndian, &header.mode); err != nil {
+		return header, err
+	}
+	if err := binary.Read(input, binary.BigEndian, &header.mtime); err != nil {
+		return header, err
+	}
+	if err := binary.Read(input, binary.BigEndian, &header.uid); err != nil {
+		return header, err
+	}
+	if err := binary.Read(input, binary.BigEndian, &header.gid); err != nil {
+		return header, err
+	}
+	if err := binary.Read(input, binary.BigEndian, &header.size); err != nil {
+		return header, err
+	}
+	var err error
+	if header.linkTarget, err = readHeaderString(input); err != nil {
+		return header, err
+	}
+	if header.hardlinkTarget, err = readHeaderString(input); err != nil {
+		return header, err
+	}
+	return header, nil
+}
+
+func writeHeaderString(output io.Writer, s string) error {
+	if err := binary.Write(output, binary.BigEndian, uint16(len(s))); err != nil {
+		return err
+	}
+	_, err := output.Write([]byte(s))
+	return err
+}
+
+func readHeaderString(input io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(input, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(input, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (h fileHeader) modTime() time.Time {
+	return time.Unix(0, h.mtime)
+}
+
+// buildFileHeader stats filePath (already lstat'd as fi) and assembles the
+// header that will be written to the archive for it, including hardlink
+// detection against every other file seen so far in this process.
+func buildFileHeader(fi os.FileInfo, filePath string) fileHeader {
+	header := fileHeader{
+		mode:  uint32(fi.Mode()),
+		mtime: fi.ModTime().UnixNano(),
+		size:  uint64(fi.Size()),
+	}
+
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		header.uid = stat.Uid
+		header.gid = stat.Gid
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Readlink(filePath); err == nil {
+			header.linkTarget = target
+		} else {
+			logger.Println("symlink read error:", err.Error())
+		}
+	} else if existing, isHardlink := checkHardlink(fi, filePath); isHardlink {
+		header.hardlinkTarget = existing
+	}
+
+	return header
+}
+
+// inodeKey identifies a file on disk by device and inode, used to detect
+// hardlinks so that a file with multiple names is only stored once.
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+var hardlinkMu sync.Mutex
+var hardlinkSeen = make(map[inodeKey]string)
+
+// checkHardlink records archivePath as the canonical copy of the inode
+// backing fi the first time it is seen, and reports the previously-seen
+// archive path on every subsequent call for the same inode. Only regular
+// files with more than one link are tracked.
+func checkHardlink(fi os.FileInfo, archivePath string) (existingPath string, isHardlink bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || !fi.Mode().IsRegular() || stat.Nlink < 2 {
+		return "", false
+	}
+
+	key := inodeKey{dev: uint64(stat.Dev), ino: stat.Ino}
+
+	hardlinkMu.Lock()
+	defer hardlinkMu.Unlock()
+
+	if existing, found := hardlinkSeen[key]; found {
+		return existing, true
+	}
+	hardlinkSeen[key] = archivePath
+	return "", false
+}
+
+// extractionDone maps an archive path to a channel that is closed once
+// writeFile has finished creating that path on disk. Hardlink records can
+// be interleaved with the file they point at in the archive stream and are
+// extracted by a separate concurrent goroutine, so linking must wait for
+// the target to actually exist first.
+var extractionDone sync.Map
+
+func extractionDoneChan(path string) chan struct{} {
+	if ch, ok := extractionDone.Load(path); ok {
+		return ch.(chan struct{})
+	}
+	ch, _ := extractionDone.LoadOrStore(path, make(chan struct{}))
+	return ch.(chan struct{})
+}
+
+// applyFileMetadata restores the ownership, permissions, and modification
+// time recorded in header onto the just-created node at path. Symlinks use
+// the L-variant of chown since chown would otherwise follow the link.
+func applyFileMetadata(path string, header fileHeader) {
+	mode := os.FileMode(header.mode)
+
+	if mode&os.ModeSymlink != 0 {
+		if err := os.Lchown(path, int(header.uid), int(header.gid)); err != nil {
+			logger.Println("symlink chown error:", err.Error())
+		}
+		// Go's standard library has no portable way to set a symlink's
+		// own mtime without following it, so it is left at creation time.
+		return
+	}
+
+	if err := os.Chown(path, int(header.uid), int(header.gid)); err != nil {
+		logger.Println("chown error:", err.Error())
+	}
+	if err := os.Chmod(path, mode.Perm()); err != nil {
+		logger.Println("chmod error:", err.Error())
+	}
+	if err := os.Chtimes(path, header.modTime(), header.modTime()); err != nil {
+		logger.Println("chtimes error:", err.Error())
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
 	"flag"
 	"io"
@@ -9,7 +10,11 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+
+	"github.com/mfenniak/fast-archiver/progress"
 )
 
 type block struct {
@@ -18,33 +23,130 @@ type block struct {
 	buffer      []byte
 	startOfFile bool
 	endOfFile   bool
+	header      *fileHeader
+	offset      uint64
+	blockDef    bool
+	blockRef    bool
+	hash        blockHash
+	// truncated marks a file abandoned mid-extraction because
+	// -continue-on-error skipped a corrupt chunk that may have carried its
+	// remaining data blocks or its endOfFileFlag; see abandonInFlight.
+	truncated bool
 }
 
 var blockSize uint16
 var verbose bool
 var logger *log.Logger
+var seekableMode bool
+
+// monitor tracks and periodically renders create/extract progress in
+// place of the scattered, ad-hoc "if verbose" log lines this package used
+// to have; see the progress package for the rendering goroutine itself.
+var monitor *progress.Monitor
 
 const dataBlockFlag byte = 1 << 0
 const startOfFileFlag byte = 1 << 1
 const endOfFileFlag byte = 1 << 2
 
+// endOfArchiveFlag terminates the record stream, immediately before the
+// table of contents trailer; it carries no path or payload. Readers must
+// stop decoding records on sight of it rather than trying to parse the
+// trailer as another record.
+const endOfArchiveFlag byte = 1 << 5
+
+// archiveMagic and archiveVersion are written at the very start of every
+// archive so that readers can detect the format and reject archives that
+// predate the per-file metadata header added in archiveVersion 2 or the
+// table of contents trailer added in archiveVersion 3.
+var archiveMagic = [4]byte{'F', 'A', 'A', 'R'}
+
+const archiveVersion uint8 = 3
+
+// formatFlagSeekable marks an archive whose data blocks each carry their
+// destination byte offset, allowing extraction to write them out of order
+// with WriteAt instead of requiring one in-order goroutine per file.
+const formatFlagSeekable byte = 1 << 0
+
+// formatFlagDedup marks an archive written with -dedup: a selected file's
+// data may reference a blockDefFlag that was only ever written for an
+// earlier, unselected file, so the TOC seek-ahead optimization (which skips
+// reading those earlier files' records entirely) can't be trusted to leave
+// dedupCache populated for every hash a selected file references. Archives
+// carrying this flag always fall back to the full streaming scan.
+const formatFlagDedup byte = 1 << 1
+
+// readArchiveHeader reads and validates the magic/version/format-flags bytes
+// at the very start of an archive stream, returning the format flags.
+// chunkSkipCount is the archiveInput's skip counter (nil for a stream that
+// isn't chunk-framed); when it's non-nil and already above zero, an error
+// reading these bytes means -continue-on-error's corrupt-chunk skip
+// consumed the entire archive -- everything fit in one chunk, which is
+// common for small archives, so the header itself was dropped along with
+// it. That's a normal, if unlucky, recovery outcome, not a bug, so it's
+// reported with Fatalln instead of the Panicln used for an error here on an
+// archive that was never being recovered in the first place.
+func readArchiveHeader(file io.Reader, chunkSkipCount func() int) byte {
+	var magic [4]byte
+	_, err := io.ReadFull(file, magic[:])
+	if err != nil {
+		if chunkSkipCount != nil && chunkSkipCount() > 0 {
+			logger.Fatalln("Archive error: archive unreadable after error recovery; a corrupt chunk may have consumed the whole (small) archive, including its header")
+		}
+		logger.Panicln("Archive read error:", err.Error())
+	}
+	if magic != archiveMagic {
+		logger.Fatalln("Archive error: unrecognized archive format")
+	}
+
+	var version uint8
+	err = binary.Read(file, binary.BigEndian, &version)
+	if err != nil {
+		if chunkSkipCount != nil && chunkSkipCount() > 0 {
+			logger.Fatalln("Archive error: archive unreadable after error recovery; a corrupt chunk may have consumed the whole (small) archive, including its header")
+		}
+		logger.Panicln("Archive read error:", err.Error())
+	}
+	if version != archiveVersion {
+		logger.Fatalln("Archive error: unsupported archive version", version)
+	}
+
+	var formatFlags byte
+	err = binary.Read(file, binary.BigEndian, &formatFlags)
+	if err != nil {
+		if chunkSkipCount != nil && chunkSkipCount() > 0 {
+			logger.Fatalln("Archive error: archive unreadable after error recovery; a corrupt chunk may have consumed the whole (small) archive, including its header")
+		}
+		logger.Panicln("Archive read error:", err.Error())
+	}
+	return formatFlags
+}
+
 func main() {
-	extract := flag.Bool("x", false, "extract archive")
+	extract := flag.Bool("x", false, "extract archive; with positional path arguments, extract only those paths")
+	list := flag.Bool("t", false, "list archive contents instead of extracting; with positional path arguments, list only those paths")
 	create := flag.Bool("c", false, "create archive")
-	inputFileName := flag.String("i", "", "input file for extraction; defaults to stdin")
+	inputFileName := flag.String("i", "", "input file for extraction or listing; defaults to stdin")
 	outputFileName := flag.String("o", "", "output file for creation; defaults to stdout")
 	requestedBlockSize := flag.Uint("block-size", 4096, "internal block-size, effective only during create archive")
 	flag.BoolVar(&verbose, "v", false, "verbose output on stderr")
+	flag.BoolVar(&seekableMode, "seekable", false, "write a seekable archive whose data blocks carry their destination offset, effective only during create archive; allows out-of-order parallel extraction")
+	flag.BoolVar(&dedupMode, "dedup", false, "deduplicate identical data blocks by content hash, effective only during create archive")
+	flag.IntVar(&dedupWindow, "dedup-window", 1<<20, "number of distinct block hashes to remember for -dedup before evicting the least-recently-seen one; 0 means unbounded")
+	showTotals := flag.Bool("progress-total", false, "pre-scan the archived directories to compute a total byte count, effective only during create archive; enables an ETA in the progress display at the cost of scanning the tree twice")
+	zFlag := flag.String("z", "none", "compress the archive stream while creating it, one of: "+strings.Join(codecNames(), ", ")+"; on extract the codec is auto-detected from a magic prefix")
+	checksumFlag := flag.Bool("checksum", false, "frame the archive stream into ~1MiB chunks, each terminated by a CRC32C, so corruption can be detected at chunk granularity on extract")
+	continueOnError := flag.Bool("continue-on-error", false, "with a checksummed archive, skip a corrupt chunk and resynchronize at the next chunk boundary instead of aborting on the first corrupt read; only recovers cleanly without -z, since skipping a chunk of a compressed archive desyncs the decompressor")
 	flag.Parse()
 
-	logger = log.New(os.Stderr, "", 0)
+	monitor = progress.New(os.Stderr, !progress.IsTerminal(os.Stderr))
+	logger = log.New(monitor.Writer(), "", 0)
 
 	if *requestedBlockSize > math.MaxUint16 {
 		logger.Fatalln("block-size must be less than or equal to", math.MaxUint16)
 	}
 	blockSize = uint16(*requestedBlockSize)
 
-	if *extract {
+	if *extract || *list {
 		var inputFile *os.File
 		if *inputFileName != "" {
 			file, err := os.Open(*inputFileName)
@@ -56,7 +158,15 @@ func main() {
 			inputFile = os.Stdin
 		}
 
-		archiveReader(inputFile)
+		in := openArchiveInput(inputFile, *continueOnError)
+
+		monitor.Start()
+		if *list {
+			listArchive(in, flag.Args())
+		} else {
+			archiveReader(in, flag.Args())
+		}
+		monitor.Stop()
 		inputFile.Close()
 
 	} else if *create {
@@ -80,7 +190,27 @@ func main() {
 			outputFile = os.Stdout
 		}
 
-		go archiveWriter(outputFile, fileWriteQueue, &workInProgress)
+		archiveWriteQueue := fileWriteQueue
+		if dedupMode {
+			archiveWriteQueue = make(chan block, 128)
+			go dedupStage(fileWriteQueue, archiveWriteQueue, dedupWindow)
+		}
+
+		archiveOutput, closeArchiveOutput, err := newArchiveOutput(outputFile, *zFlag, *checksumFlag)
+		if err != nil {
+			logger.Fatalln(err.Error())
+		}
+
+		if *showTotals {
+			monitor.Update(progress.Update{BytesTotal: sumSizes(flag.Args())})
+		}
+
+		monitor.Start()
+		archiveWriterDone := make(chan struct{})
+		go func() {
+			archiveWriter(archiveOutput, archiveWriteQueue, &workInProgress)
+			close(archiveWriterDone)
+		}()
 		for i := 0; i < 16; i++ {
 			go directoryScanner(directoryScanQueue, fileReadQueue, &workInProgress)
 		}
@@ -97,27 +227,61 @@ func main() {
 		close(directoryScanQueue)
 		close(fileReadQueue)
 		close(fileWriteQueue)
+		// archiveWriter still has the table-of-contents trailer to write
+		// after its input channel drains, so wait for it before closing
+		// the file out from under it.
+		<-archiveWriterDone
+		monitor.Stop()
+		if err := closeArchiveOutput(); err != nil {
+			logger.Fatalln("Error closing archive output:", err.Error())
+		}
 		outputFile.Close()
 	} else {
 		logger.Fatalln("extract (-x) or create (-c) flag must be provided")
 	}
 }
 
+// sumSizes lstats every regular file under roots and returns the total byte
+// count, for the -progress-total pre-pass; directories, symlinks, and other
+// non-regular entries contribute nothing since they carry no data blocks.
+func sumSizes(roots []string) int64 {
+	var total int64
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				total += info.Size()
+			}
+			return nil
+		})
+	}
+	return total
+}
+
 func directoryScanner(directoryScanQueue chan string, fileReadQueue chan string, workInProgress *sync.WaitGroup) {
 	for directoryPath := range directoryScanQueue {
 		if verbose {
 			logger.Println(directoryPath)
 		}
+		monitor.Update(progress.Update{CurrentFile: directoryPath})
 
 		files, err := ioutil.ReadDir(directoryPath)
 		if err == nil {
-			workInProgress.Add(len(files))
 			for _, file := range files {
 				filePath := filepath.Join(directoryPath, file.Name())
+				monitor.Update(progress.Update{FilesScanned: 1})
+
+				// Every entry -- regular file, directory, symlink, or
+				// fifo -- is archived as its own "file" record so its
+				// metadata round-trips. ioutil.ReadDir lstats each entry,
+				// so a symlink pointing at a directory reports IsDir()
+				// false here and is archived as a symlink rather than
+				// being descended into.
+				workInProgress.Add(1)
+				fileReadQueue <- filePath
+
 				if file.IsDir() {
+					workInProgress.Add(1)
 					directoryScanQueue <- filePath
-				} else {
-					fileReadQueue <- filePath
 				}
 			}
 		} else {
@@ -133,91 +297,302 @@ func fileReader(fileReadQueue <-chan string, fileWriterQueue chan block, workInP
 		if verbose {
 			logger.Println(filePath)
 		}
+		monitor.Update(progress.Update{CurrentFile: filePath})
 
-		file, err := os.Open(filePath)
-		if err == nil {
-			workInProgress.Add(1)
-			fileWriterQueue <- block{filePath, 0, nil, true, false}
-
-			for {
-				buffer := make([]byte, blockSize)
-				bytesRead, err := file.Read(buffer)
-				if err == io.EOF {
-					break
-				} else if err != nil {
-					logger.Println("file read error; file contents will be incomplete:", err.Error())
-					break
+		fi, err := os.Lstat(filePath)
+		if err != nil {
+			logger.Println("file stat error:", err.Error())
+			workInProgress.Done()
+			continue
+		}
+
+		header := buildFileHeader(fi, filePath)
+
+		workInProgress.Add(1)
+		fileWriterQueue <- block{filePath: filePath, startOfFile: true, header: &header}
+
+		// Regular files with no other name yet seen are the only entries
+		// that carry data blocks; directories, symlinks, and hardlinks are
+		// fully described by the header alone.
+		if fi.Mode().IsRegular() && header.hardlinkTarget == "" {
+			file, err := os.Open(filePath)
+			if err == nil {
+				var offset uint64
+				if dedupMode {
+					// Fixed-offset blockSize reads would shift every later
+					// block's boundary (and hash) after any edit earlier in
+					// the file, defeating dedup's whole purpose; use
+					// content-defined boundaries instead.
+					chunker := newContentDefinedChunker(bufio.NewReader(file), blockSize)
+					for {
+						buffer, err := chunker.next()
+						if err == io.EOF {
+							break
+						} else if err != nil {
+							logger.Println("file read error; file contents will be incomplete:", err.Error())
+							break
+						}
+
+						workInProgress.Add(1)
+						fileWriterQueue <- block{filePath: filePath, numBytes: uint16(len(buffer)), buffer: buffer, offset: offset}
+						offset += uint64(len(buffer))
+						monitor.Update(progress.Update{BytesRead: int64(len(buffer))})
+					}
+				} else {
+					for {
+						buffer := make([]byte, blockSize)
+						bytesRead, err := file.Read(buffer)
+						if err == io.EOF {
+							break
+						} else if err != nil {
+							logger.Println("file read error; file contents will be incomplete:", err.Error())
+							break
+						}
+
+						workInProgress.Add(1)
+						fileWriterQueue <- block{filePath: filePath, numBytes: uint16(bytesRead), buffer: buffer, offset: offset}
+						offset += uint64(bytesRead)
+						monitor.Update(progress.Update{BytesRead: int64(bytesRead)})
+					}
 				}
 
-				workInProgress.Add(1)
-				fileWriterQueue <- block{filePath, uint16(bytesRead), buffer, false, false}
+				file.Close()
+			} else {
+				logger.Println("file open error:", err.Error())
 			}
-
-			workInProgress.Add(1)
-			fileWriterQueue <- block{filePath, 0, nil, false, true}
-
-			file.Close()
-		} else {
-			logger.Println("file open error:", err.Error())
 		}
 
+		workInProgress.Add(1)
+		fileWriterQueue <- block{filePath: filePath, endOfFile: true}
+		monitor.Update(progress.Update{FilesCompleted: 1})
+
 		workInProgress.Done()
 	}
 }
 
-func archiveWriter(output *os.File, fileWriterQueue <-chan block, workInProgress *sync.WaitGroup) {
+func archiveWriter(output io.Writer, fileWriterQueue <-chan block, workInProgress *sync.WaitGroup) {
 	flags := make([]byte, 1)
+	cw := &countingWriter{w: output}
+	var index []tocEntry
+	// Set only when output is a bare chunkWriter (-checksum without -z);
+	// signals the record boundary below so chunk boundaries align with
+	// record boundaries and -continue-on-error can actually resynchronize.
+	// With -z also set, output is a codec wrapping the chunkWriter instead,
+	// which doesn't implement this, since compressed bytes don't correspond
+	// to record boundaries anyway.
+	bf, _ := output.(boundaryFlusher)
+
+	if _, err := cw.Write(archiveMagic[:]); err != nil {
+		logger.Panicln("Archive write error:", err.Error())
+	}
+	if err := binary.Write(cw, binary.BigEndian, archiveVersion); err != nil {
+		logger.Panicln("Archive write error:", err.Error())
+	}
+
+	var formatFlags byte
+	if seekableMode {
+		formatFlags |= formatFlagSeekable
+	}
+	if dedupMode {
+		formatFlags |= formatFlagDedup
+	}
+	if err := binary.Write(cw, binary.BigEndian, formatFlags); err != nil {
+		logger.Panicln("Archive write error:", err.Error())
+	}
 
 	for block := range fileWriterQueue {
+		writtenBefore := cw.written
+		var headerOffset uint64
+		if block.startOfFile {
+			headerOffset = cw.written
+		}
+
 		filePath := []byte(block.filePath)
-		err := binary.Write(output, binary.BigEndian, uint16(len(filePath)))
+		err := binary.Write(cw, binary.BigEndian, uint16(len(filePath)))
 		if err != nil {
 			logger.Panicln("Archive write error:", err.Error())
 		}
-		_, err = output.Write(filePath)
+		_, err = cw.Write(filePath)
 		if err != nil {
 			logger.Panicln("Archive write error:", err.Error())
 		}
 
 		if block.startOfFile {
 			flags[0] = startOfFileFlag
-			_, err = output.Write(flags)
+			_, err = cw.Write(flags)
 			if err != nil {
 				logger.Panicln("Archive write error:", err.Error())
 			}
+
+			err = writeFileHeader(cw, *block.header)
+			if err != nil {
+				logger.Panicln("Archive write error:", err.Error())
+			}
+
+			index = append(index, tocEntry{path: block.filePath, headerOffset: headerOffset, totalBytes: block.header.size})
 		} else if block.endOfFile {
 			flags[0] = endOfFileFlag
-			_, err = output.Write(flags)
+			_, err = cw.Write(flags)
 			if err != nil {
 				logger.Panicln("Archive write error:", err.Error())
 			}
 		} else {
-			flags[0] = dataBlockFlag
-			_, err = output.Write(flags)
+			switch {
+			case block.blockDef:
+				flags[0] = blockDefFlag
+			case block.blockRef:
+				flags[0] = blockRefFlag
+			default:
+				flags[0] = dataBlockFlag
+			}
+			_, err = cw.Write(flags)
 			if err != nil {
 				logger.Panicln("Archive write error:", err.Error())
 			}
 
-			err = binary.Write(output, binary.BigEndian, uint16(block.numBytes))
-			if err != nil {
-				logger.Panicln("Archive write error:", err.Error())
+			if seekableMode {
+				err = binary.Write(cw, binary.BigEndian, block.offset)
+				if err != nil {
+					logger.Panicln("Archive write error:", err.Error())
+				}
 			}
 
-			_, err = output.Write(block.buffer[:block.numBytes])
-			if err != nil {
+			if block.blockRef {
+				_, err = cw.Write(block.hash[:])
+				if err != nil {
+					logger.Panicln("Archive write error:", err.Error())
+				}
+			} else {
+				if block.blockDef {
+					_, err = cw.Write(block.hash[:])
+					if err != nil {
+						logger.Panicln("Archive write error:", err.Error())
+					}
+				}
+
+				err = binary.Write(cw, binary.BigEndian, uint16(block.numBytes))
+				if err != nil {
+					logger.Panicln("Archive write error:", err.Error())
+				}
+
+				_, err = cw.Write(block.buffer[:block.numBytes])
+				if err != nil {
+					logger.Panicln("Archive write error:", err.Error())
+				}
+			}
+		}
+
+		monitor.Update(progress.Update{BytesWritten: int64(cw.written - writtenBefore)})
+
+		if bf != nil {
+			if err := bf.FlushBoundary(); err != nil {
 				logger.Panicln("Archive write error:", err.Error())
 			}
 		}
 
 		workInProgress.Done()
 	}
+
+	if err := binary.Write(cw, binary.BigEndian, uint16(0)); err != nil {
+		logger.Panicln("Archive write error:", err.Error())
+	}
+	flags[0] = endOfArchiveFlag
+	if _, err := cw.Write(flags); err != nil {
+		logger.Panicln("Archive write error:", err.Error())
+	}
+
+	if err := writeTOC(cw, index); err != nil {
+		logger.Panicln("Archive write error:", err.Error())
+	}
 }
 
-func archiveReader(file *os.File) {
+// archiveReader extracts in, writing every archived path unless selected is
+// non-empty, in which case only those paths are extracted. When in.seekFile
+// is set (a plain, un-wrapped archive on a seekable regular file) and
+// selected is non-empty, the table of contents trailer is consulted to jump
+// past any leading files that were archived before the earliest requested
+// one; files archived after that point still interleave their data blocks
+// arbitrarily (fileReader's 16 workers scan concurrently), so the remainder
+// of the stream is scanned and filtered rather than read in one contiguous
+// run per file. A compressed or chunk-framed archive has no seekFile, since
+// its byte offsets no longer correspond to positions in the underlying
+// file, so it always falls back to this same streaming scan. An archive
+// written with -dedup also always falls back to it: a selected file's data
+// may blockRefFlag a hash whose only blockDefFlag sits in an earlier,
+// unselected file, and seeking past that file would skip the def entirely.
+func archiveReader(in archiveInput, selected []string) {
+	file := in.r
 	var workInProgress sync.WaitGroup
 	fileOutputChan := make(map[string]chan block)
 
+	var selectedSet map[string]bool
+	if len(selected) > 0 {
+		selectedSet = make(map[string]bool, len(selected))
+		for _, path := range selected {
+			selectedSet[path] = true
+		}
+	}
+	// skip tracks in-flight paths that were excluded by selectedSet; their
+	// records are still parsed, to stay in sync with the stream and to
+	// keep dedupCache populated for defs that a selected file might later
+	// reference, but never written to disk.
+	skip := make(map[string]bool)
+
+	formatFlags := readArchiveHeader(file, in.chunkSkipCount)
+	seekable := formatFlags&formatFlagSeekable != 0
+	dedupArchive := formatFlags&formatFlagDedup != 0
+
+	if selectedSet != nil && in.seekFile != nil && !dedupArchive {
+		seekFile := in.seekFile
+		afterHeaderPos, _ := seekFile.Seek(0, io.SeekCurrent)
+		if index, err := readTOC(seekFile); err == nil {
+			// A selected hardlink whose target isn't itself selected would
+			// otherwise block forever in writeFile, waiting on a target
+			// that's never written (see extractionDoneChan below); pull
+			// every such target into selectedSet before deciding how far
+			// ahead it's safe to seek.
+			resolveHardlinkTargets(seekFile, index, selectedSet)
+			if offset, ok := minHeaderOffset(index, selectedSet); ok {
+				afterHeaderPos = int64(offset)
+			}
+		}
+		if _, err := seekFile.Seek(afterHeaderPos, io.SeekStart); err != nil {
+			logger.Panicln("Archive seek error:", err.Error())
+		}
+	}
+
+	// seekableRegular tracks, for a seekable-format archive, which
+	// in-flight paths are regular files being written out-of-order by the
+	// extractor pool rather than in-order through the per-path channel
+	// below.
+	var extractor *seekableExtractor
+	seekableRegular := make(map[string]bool)
+	if seekable {
+		extractor = newSeekableExtractor(&workInProgress)
+	}
+
+	// dedupCache holds every block emitted as a blockDefFlag so that a
+	// later blockRefFlag for the same hash can be materialized back into
+	// bytes. It is never evicted: a ref can reference a def written
+	// arbitrarily far earlier in the stream, so the reader must be able to
+	// retain every distinct block's content for the life of the archive.
+	dedupCache := make(map[blockHash][]byte)
+
+	// lastChunkSkips tracks in.chunkSkipCount's last-seen value so a skip
+	// that happened since the previous record is only handled once, right
+	// before decoding the record that follows it -- chunk boundaries align
+	// with record boundaries (see chunkWriter.FlushBoundary), so that's
+	// always the first point a skip could have landed.
+	lastChunkSkips := 0
+
 	for {
+		if in.chunkSkipCount != nil {
+			if n := in.chunkSkipCount(); n > lastChunkSkips {
+				lastChunkSkips = n
+				abandonInFlight(fileOutputChan, seekableRegular, extractor)
+			}
+		}
+
 		var pathSize uint16
 		err := binary.Read(file, binary.BigEndian, &pathSize)
 		if err == io.EOF {
@@ -239,68 +614,244 @@ func archiveReader(file *os.File) {
 			logger.Panicln("Archive read error:", err.Error())
 		}
 
-		if flag[0] == startOfFileFlag {
-			c := make(chan block, 1)
-			fileOutputChan[filePath] = c
-			workInProgress.Add(1)
-			go writeFile(c, &workInProgress)
-			c <- block{filePath, 0, nil, true, false}
-		} else if flag[0] == endOfFileFlag {
-			c := fileOutputChan[filePath]
-			c <- block{filePath, 0, nil, false, true}
-			close(c)
-			delete(fileOutputChan, filePath)
-		} else if flag[0] == dataBlockFlag {
-			var blockSize uint16
-			err = binary.Read(file, binary.BigEndian, &blockSize)
+		if flag[0] == endOfArchiveFlag {
+			break
+		} else if flag[0] == startOfFileFlag {
+			header, err := readFileHeader(file)
 			if err != nil {
 				logger.Panicln("Archive read error:", err.Error())
 			}
 
-			blockData := make([]byte, blockSize)
-			_, err = io.ReadFull(file, blockData)
-			if err != nil {
-				logger.Panicln("Archive read error:", err.Error())
+			if selectedSet != nil && !selectedSet[filePath] {
+				skip[filePath] = true
+			} else {
+				mode := os.FileMode(header.mode)
+				if seekable && mode.IsRegular() && header.hardlinkTarget == "" {
+					seekableRegular[filePath] = true
+					extractor.startFile(filePath, header)
+				} else {
+					c := make(chan block, 1)
+					fileOutputChan[filePath] = c
+					workInProgress.Add(1)
+					go writeFile(c, &workInProgress)
+					c <- block{filePath: filePath, startOfFile: true, header: &header}
+				}
+			}
+		} else if flag[0] == endOfFileFlag {
+			if skip[filePath] {
+				delete(skip, filePath)
+				// A selected hardlink whose target was skipped (possible
+				// when the input isn't seekable, so resolveHardlinkTargets
+				// never ran) would otherwise block on this path's
+				// extractionDoneChan forever; close it so writeFile
+				// unblocks and fails the hardlink explicitly instead.
+				close(extractionDoneChan(filePath))
+			} else if seekableRegular[filePath] {
+				extractor.endFile(filePath)
+				delete(seekableRegular, filePath)
+			} else if c, ok := fileOutputChan[filePath]; ok {
+				c <- block{filePath: filePath, endOfFile: true}
+				close(c)
+				delete(fileOutputChan, filePath)
 			}
+			// else: this path's startOfFileFlag fell before the TOC
+			// seek-ahead target and was never read; nothing to finalize.
+		} else if flag[0] == dataBlockFlag || flag[0] == blockDefFlag || flag[0] == blockRefFlag {
+			var offset uint64
+			if seekable {
+				err = binary.Read(file, binary.BigEndian, &offset)
+				if err != nil {
+					logger.Panicln("Archive read error:", err.Error())
+				}
+			}
+
+			var blockData []byte
+			if flag[0] == blockRefFlag {
+				var hash blockHash
+				_, err = io.ReadFull(file, hash[:])
+				if err != nil {
+					logger.Panicln("Archive read error:", err.Error())
+				}
+				var ok bool
+				blockData, ok = dedupCache[hash]
+				if !ok {
+					logger.Panicln("Archive error: block reference to unseen hash")
+				}
+			} else {
+				var hash blockHash
+				if flag[0] == blockDefFlag {
+					_, err = io.ReadFull(file, hash[:])
+					if err != nil {
+						logger.Panicln("Archive read error:", err.Error())
+					}
+				}
+
+				var blockSize uint16
+				err = binary.Read(file, binary.BigEndian, &blockSize)
+				if err != nil {
+					logger.Panicln("Archive read error:", err.Error())
+				}
+
+				blockData = make([]byte, blockSize)
+				_, err = io.ReadFull(file, blockData)
+				if err != nil {
+					logger.Panicln("Archive read error:", err.Error())
+				}
 
-			c := fileOutputChan[filePath]
-			c <- block{filePath, blockSize, blockData, false, false}
+				if flag[0] == blockDefFlag {
+					dedupCache[hash] = blockData
+				}
+			}
+
+			if skip[filePath] {
+				// already parsed to stay in sync with the stream and to
+				// populate dedupCache; nothing to write.
+			} else if seekableRegular[filePath] {
+				extractor.submitBlock(filePath, offset, blockData)
+			} else if c, ok := fileOutputChan[filePath]; ok {
+				c <- block{filePath: filePath, numBytes: uint16(len(blockData)), buffer: blockData}
+			}
+			// else: orphaned block for a path whose startOfFileFlag fell
+			// before the TOC seek-ahead target.
 		} else {
 			logger.Panicln("Archive error: unrecognized block flag", flag[0])
 		}
 	}
 
-	file.Close()
+	// A well-formed stream only reaches here with both maps already empty:
+	// archiveWriter writes endOfArchiveFlag (the ordinary way out of the loop
+	// above) only once every file's endOfFileFlag has already gone out, and
+	// a truncated stream breaks out via the io.EOF case instead. Either way,
+	// anything still in-flight at this point was truncated by a skipped
+	// chunk that took the rest of the stream -- including, potentially, the
+	// skip that was detected too late in the loop above to act on because it
+	// surfaced as this same io.EOF rather than on a subsequent iteration.
+	abandonInFlight(fileOutputChan, seekableRegular, extractor)
+
+	if extractor != nil {
+		extractor.wait()
+	}
 	workInProgress.Wait()
 }
 
+// abandonInFlight is called once in.chunkSkipCount reports a new corrupt
+// chunk skipped under -continue-on-error, and once more after the record
+// loop ends, to catch a skip that swallowed everything after it, including
+// the endOfArchiveFlag. Any file that was mid-extraction at such a point may
+// never get the rest of its data blocks or its endOfFileFlag, since those
+// could have been exactly what the skip dropped, which would otherwise
+// leave its writeFile goroutine (or, in seekable mode, the extractor)
+// waiting on them forever. Every such file is logged as incomplete and its
+// extraction is force-finished instead.
+func abandonInFlight(fileOutputChan map[string]chan block, seekableRegular map[string]bool, extractor *seekableExtractor) {
+	for path, c := range fileOutputChan {
+		logger.Println("file incomplete: a corrupt chunk was skipped while it was being extracted:", path)
+		c <- block{filePath: path, truncated: true}
+		close(c)
+		delete(fileOutputChan, path)
+	}
+	for path := range seekableRegular {
+		logger.Println("file incomplete: a corrupt chunk was skipped while it was being extracted:", path)
+		extractor.abandon(path)
+		delete(seekableRegular, path)
+	}
+}
+
+// removeExisting removes any existing node at path, ignoring the case where
+// nothing is there. Unlike os.Create, os.Symlink and syscall.Mkfifo fail if
+// the destination already exists, so re-extracting an archive into a
+// directory it was already extracted into would otherwise panic on its
+// second run.
+func removeExisting(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logger.Println("file remove error:", err.Error())
+	}
+}
+
 func writeFile(blockSource chan block, workInProgress *sync.WaitGroup) {
 	var file *os.File = nil
+	var filePath string
+	var header fileHeader
+
 	for block := range blockSource {
 		if block.startOfFile {
+			filePath = block.filePath
+			header = *block.header
+			mode := os.FileMode(header.mode)
+
 			if verbose {
-				logger.Println(block.filePath)
+				logger.Println(filePath)
 			}
+			monitor.Update(progress.Update{CurrentFile: filePath, BytesTotal: int64(header.size)})
 
-			dir, _ := filepath.Split(block.filePath)
-			err := os.MkdirAll(dir, os.ModeDir|0755)
-			if err != nil {
-				logger.Panicln("Directory create error:", err.Error())
+			dir, _ := filepath.Split(filePath)
+			if dir != "" {
+				err := os.MkdirAll(dir, os.ModeDir|0755)
+				if err != nil {
+					logger.Panicln("Directory create error:", err.Error())
+				}
 			}
 
-			tmp, err := os.Create(block.filePath)
-			if err != nil {
-				logger.Panicln("File create error:", err.Error())
+			var err error
+			switch {
+			case header.hardlinkTarget != "":
+				<-extractionDoneChan(header.hardlinkTarget)
+				err = os.Link(header.hardlinkTarget, filePath)
+				if err != nil {
+					// A selective extract of just a hardlink, without its
+					// target, is a legitimate selection the target was
+					// never written to disk for; don't abort the whole
+					// extraction over it.
+					logger.Println("Hardlink create error:", err.Error())
+				}
+			case mode&os.ModeSymlink != 0:
+				removeExisting(filePath)
+				err = os.Symlink(header.linkTarget, filePath)
+				if err != nil {
+					logger.Panicln("Symlink create error:", err.Error())
+				}
+			case mode&os.ModeDir != 0:
+				err = os.MkdirAll(filePath, mode.Perm())
+				if err != nil {
+					logger.Panicln("Directory create error:", err.Error())
+				}
+			case mode&os.ModeNamedPipe != 0:
+				removeExisting(filePath)
+				err = syscall.Mkfifo(filePath, uint32(mode.Perm()))
+				if err != nil {
+					logger.Panicln("Fifo create error:", err.Error())
+				}
+			default:
+				tmp, err := os.Create(filePath)
+				if err != nil {
+					logger.Panicln("File create error:", err.Error())
+				}
+				file = tmp
 			}
-			file = tmp
 		} else if block.endOfFile {
-			file.Close()
-			file = nil
+			if file != nil {
+				file.Close()
+				file = nil
+			}
+			applyFileMetadata(filePath, header)
+			close(extractionDoneChan(filePath))
+			monitor.Update(progress.Update{FilesCompleted: 1})
+		} else if block.truncated {
+			// abandonInFlight already logged which file this is; just
+			// release what it was holding so the goroutine can exit instead
+			// of blocking on a record that a skipped chunk may have taken
+			// with it.
+			if file != nil {
+				file.Close()
+				file = nil
+			}
+			close(extractionDoneChan(filePath))
 		} else {
 			_, err := file.Write(block.buffer[:block.numBytes])
 			if err != nil {
 				logger.Panicln("File write error:", err.Error())
 			}
+			monitor.Update(progress.Update{BytesWritten: int64(block.numBytes)})
 		}
 	}
 	workInProgress.Done()
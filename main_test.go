@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mfenniak/fast-archiver/progress"
+)
+
+func TestMain(m *testing.M) {
+	monitor = progress.New(io.Discard, true)
+	logger = log.New(io.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// writeTestArchive drives archiveWriter directly with a pre-built sequence
+// of blocks, bypassing directoryScanner/fileReader, so a test can construct
+// exactly the record layout it needs.
+func writeTestArchive(t *testing.T, path string, blocks []block) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	queue := make(chan block, len(blocks))
+	for _, b := range blocks {
+		queue <- b
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	wg.Add(len(blocks))
+	archiveWriter(f, queue, &wg)
+	wg.Wait()
+}
+
+// TestSelectiveExtractHardlinkTargetNotSelected guards against the deadlock
+// a selective -x used to hit when it requested only a hardlink's path: the
+// hardlink's goroutine waits on extractionDoneChan(target), which nothing
+// ever closed once the target itself was excluded by selectedSet.
+func TestSelectiveExtractHardlinkTargetNotSelected(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "archive.far")
+	realPath := filepath.Join(dir, "out", "real.txt")
+	linkPath := filepath.Join(dir, "out", "link.txt")
+
+	data := []byte("hello world")
+	blocks := []block{
+		{filePath: realPath, startOfFile: true, header: &fileHeader{mode: uint32(0100644), size: uint64(len(data))}},
+		{filePath: realPath, numBytes: uint16(len(data)), buffer: data},
+		{filePath: realPath, endOfFile: true},
+		{filePath: linkPath, startOfFile: true, header: &fileHeader{mode: uint32(0100644), hardlinkTarget: realPath}},
+		{filePath: linkPath, endOfFile: true},
+	}
+	writeTestArchive(t, archivePath, blocks)
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	in := openArchiveInput(f, false)
+
+	done := make(chan struct{})
+	go func() {
+		archiveReader(in, []string{linkPath})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("archiveReader deadlocked extracting a hardlink whose target wasn't itself selected")
+	}
+
+	if _, err := os.Lstat(linkPath); err != nil {
+		t.Fatalf("expected %s to be extracted: %v", linkPath, err)
+	}
+	if _, err := os.Lstat(realPath); err != nil {
+		t.Fatalf("expected %s to be pulled in as the hardlink's target: %v", realPath, err)
+	}
+
+	got, err := os.ReadFile(linkPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+}
+
+// TestSelectiveExtractDedupRefInUnselectedFile guards against a selective -x
+// panicking with "block reference to unseen hash": the TOC seek-ahead
+// optimization used to jump straight to the selected file's header even on
+// a -dedup archive, skipping the earlier, unselected file whose blockDefFlag
+// the selected file's blockRefFlag depends on. formatFlagDedup now disables
+// the seek-ahead for such archives so the full stream, including that def,
+// is always read first.
+func TestSelectiveExtractDedupRefInUnselectedFile(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "archive.far")
+	firstPath := filepath.Join(dir, "out", "first.txt")
+	secondPath := filepath.Join(dir, "out", "second.txt")
+
+	data := []byte("duplicate content shared by both files")
+	hash := hashBlock(data)
+
+	dedupMode = true
+	defer func() { dedupMode = false }()
+
+	blocks := []block{
+		{filePath: firstPath, startOfFile: true, header: &fileHeader{mode: uint32(0100644), size: uint64(len(data))}},
+		{filePath: firstPath, blockDef: true, hash: hash, numBytes: uint16(len(data)), buffer: data},
+		{filePath: firstPath, endOfFile: true},
+		{filePath: secondPath, startOfFile: true, header: &fileHeader{mode: uint32(0100644), size: uint64(len(data))}},
+		{filePath: secondPath, blockRef: true, hash: hash},
+		{filePath: secondPath, endOfFile: true},
+	}
+	writeTestArchive(t, archivePath, blocks)
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	in := openArchiveInput(f, false)
+
+	done := make(chan struct{})
+	var panicked interface{}
+	go func() {
+		defer close(done)
+		defer func() { panicked = recover() }()
+		archiveReader(in, []string{secondPath})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("archiveReader deadlocked extracting a dedup ref whose def lives in an unselected file")
+	}
+	if panicked != nil {
+		t.Fatalf("archiveReader panicked extracting a dedup ref whose def lives in an unselected file: %v", panicked)
+	}
+
+	got, err := os.ReadFile(secondPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+	if _, err := os.Lstat(firstPath); err == nil {
+		t.Fatalf("expected %s not to be extracted since it wasn't selected", firstPath)
+	}
+}
+
+// TestExtractSymlinkTwiceDoesNotPanic guards against writeFile panicking the
+// second time an archive carrying a symlink is extracted into the same
+// directory: unlike the regular-file path (os.Create, which truncates an
+// existing path), os.Symlink fails outright if the destination already
+// exists.
+func TestExtractSymlinkTwiceDoesNotPanic(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "archive.far")
+	linkPath := filepath.Join(dir, "out", "link")
+
+	blocks := []block{
+		{filePath: linkPath, startOfFile: true, header: &fileHeader{mode: uint32(os.ModeSymlink | 0777), linkTarget: "/etc/hosts"}},
+		{filePath: linkPath, endOfFile: true},
+	}
+	writeTestArchive(t, archivePath, blocks)
+
+	for i := 0; i < 2; i++ {
+		// extractionDone is a process-global map keyed by archive path; in
+		// the real binary each extraction is its own process, but this test
+		// drives archiveReader twice in one, so it has to clear the stale
+		// entry from the first run itself.
+		extractionDone.Delete(linkPath)
+
+		f, err := os.Open(archivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := openArchiveInput(f, false)
+		archiveReader(in, nil)
+		f.Close()
+
+		target, err := os.Readlink(linkPath)
+		if err != nil {
+			t.Fatalf("extraction %d: %v", i+1, err)
+		}
+		if target != "/etc/hosts" {
+			t.Fatalf("extraction %d: expected link target /etc/hosts, got %q", i+1, target)
+		}
+	}
+}
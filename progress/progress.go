@@ -0,0 +1,273 @@
+// Package progress provides a small status-reporting subsystem used by
+// fast-archiver's create and extract paths in place of scattered, ad-hoc
+// verbose log lines. A single goroutine owns every counter and renders
+// them periodically; workers only ever push non-blocking Updates, so a
+// slow or blocked renderer can never stall the hot path.
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// renderInterval is how often the monitor goroutine redraws its status
+// line, or emits a JSON event when output is not a terminal.
+const renderInterval = 100 * time.Millisecond
+
+// Update reports forward progress from a worker goroutine. Zero-valued
+// fields are treated as "nothing to report" rather than an explicit zero,
+// so a caller only needs to set the fields it has something to say about.
+type Update struct {
+	FilesScanned   int64
+	FilesCompleted int64
+	BytesRead      int64
+	BytesWritten   int64
+	BytesTotal     int64
+	CurrentFile    string
+}
+
+// event is the newline-delimited JSON record emitted once per render tick
+// when the monitor's output is not a terminal.
+type event struct {
+	Time           string `json:"time"`
+	FilesScanned   int64  `json:"files_scanned"`
+	FilesCompleted int64  `json:"files_completed"`
+	BytesRead      int64  `json:"bytes_read"`
+	BytesWritten   int64  `json:"bytes_written"`
+	BytesTotal     int64  `json:"bytes_total,omitempty"`
+	CurrentFile    string `json:"current_file,omitempty"`
+}
+
+// Monitor owns every progress counter and the single goroutine that
+// periodically renders them, modeled on restic's ui.Backup.
+type Monitor struct {
+	out      io.Writer
+	jsonMode bool
+	updates  chan Update
+	done     chan struct{}
+	stopped  chan struct{}
+	start    time.Time
+
+	filesScanned   int64
+	filesCompleted int64
+	bytesRead      int64
+	bytesWritten   int64
+	bytesTotal     int64
+
+	mu          sync.Mutex
+	currentFile string
+	lastLineLen int
+}
+
+// New creates a Monitor that renders to out every 100ms: a single
+// self-overwriting status line when jsonMode is false, or one
+// newline-delimited JSON event per tick when it is true. Callers
+// typically set jsonMode to !IsTerminal(out).
+func New(out io.Writer, jsonMode bool) *Monitor {
+	return &Monitor{
+		out:      out,
+		jsonMode: jsonMode,
+		updates:  make(chan Update, 256),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		start:    time.Now(),
+	}
+}
+
+// IsTerminal reports whether f looks like an interactive terminal rather
+// than a pipe, redirected file, or /dev/null.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Start launches the rendering goroutine. Must be called at most once.
+func (m *Monitor) Start() {
+	go m.run()
+}
+
+// Update pushes a progress delta onto the channel without blocking. If
+// the channel is momentarily full the update is dropped silently; the
+// next one supersedes it, so nothing is lost but a single render tick.
+func (m *Monitor) Update(u Update) {
+	select {
+	case m.updates <- u:
+	default:
+	}
+}
+
+// Writer returns an io.Writer suitable for a log.Logger: every write
+// clears the monitor's in-progress status line first so ordinary log
+// output and the self-overwriting status line never garble each other.
+// The next render tick redraws the status line below the logged message.
+func (m *Monitor) Writer() io.Writer {
+	return &lineClearingWriter{m: m}
+}
+
+// Stop flushes a final, complete render and halts the goroutine. Must be
+// called exactly once, after the last Update.
+func (m *Monitor) Stop() {
+	close(m.done)
+	<-m.stopped
+}
+
+func (m *Monitor) run() {
+	defer close(m.stopped)
+	ticker := time.NewTicker(renderInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case u := <-m.updates:
+			m.apply(u)
+		case <-ticker.C:
+			m.render()
+		case <-m.done:
+			m.drain()
+			m.render()
+			if !m.jsonMode {
+				fmt.Fprint(m.out, "\n")
+			}
+			return
+		}
+	}
+}
+
+// drain applies any updates sent just before Stop, so the final render is
+// accurate rather than racing the close of m.done.
+func (m *Monitor) drain() {
+	for {
+		select {
+		case u := <-m.updates:
+			m.apply(u)
+		default:
+			return
+		}
+	}
+}
+
+func (m *Monitor) apply(u Update) {
+	if u.FilesScanned != 0 {
+		atomic.AddInt64(&m.filesScanned, u.FilesScanned)
+	}
+	if u.FilesCompleted != 0 {
+		atomic.AddInt64(&m.filesCompleted, u.FilesCompleted)
+	}
+	if u.BytesRead != 0 {
+		atomic.AddInt64(&m.bytesRead, u.BytesRead)
+	}
+	if u.BytesWritten != 0 {
+		atomic.AddInt64(&m.bytesWritten, u.BytesWritten)
+	}
+	if u.BytesTotal != 0 {
+		atomic.AddInt64(&m.bytesTotal, u.BytesTotal)
+	}
+	if u.CurrentFile != "" {
+		m.mu.Lock()
+		m.currentFile = u.CurrentFile
+		m.mu.Unlock()
+	}
+}
+
+func (m *Monitor) render() {
+	filesScanned := atomic.LoadInt64(&m.filesScanned)
+	filesCompleted := atomic.LoadInt64(&m.filesCompleted)
+	bytesRead := atomic.LoadInt64(&m.bytesRead)
+	bytesWritten := atomic.LoadInt64(&m.bytesWritten)
+	bytesTotal := atomic.LoadInt64(&m.bytesTotal)
+	m.mu.Lock()
+	currentFile := m.currentFile
+	m.mu.Unlock()
+
+	if m.jsonMode {
+		enc := json.NewEncoder(m.out)
+		enc.Encode(event{
+			Time:           time.Now().UTC().Format(time.RFC3339),
+			FilesScanned:   filesScanned,
+			FilesCompleted: filesCompleted,
+			BytesRead:      bytesRead,
+			BytesWritten:   bytesWritten,
+			BytesTotal:     bytesTotal,
+			CurrentFile:    currentFile,
+		})
+		return
+	}
+
+	elapsed := time.Since(m.start).Seconds()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(bytesWritten) / elapsed
+	}
+
+	var line string
+	if bytesTotal > 0 {
+		pct := float64(bytesWritten) / float64(bytesTotal) * 100
+		eta := "?"
+		if rate > 0 && bytesTotal > bytesWritten {
+			eta = (time.Duration(float64(bytesTotal-bytesWritten)/rate) * time.Second).String()
+		}
+		line = fmt.Sprintf("%d files, %s/%s (%.1f%%), %s/s, ETA %s",
+			filesCompleted, formatBytes(bytesWritten), formatBytes(bytesTotal), pct, formatBytes(int64(rate)), eta)
+	} else {
+		line = fmt.Sprintf("%d files scanned, %d files done, %s, %s/s",
+			filesScanned, filesCompleted, formatBytes(bytesWritten), formatBytes(int64(rate)))
+	}
+	if currentFile != "" {
+		line = fmt.Sprintf("%s -- %s", line, currentFile)
+	}
+
+	m.writeLine(line)
+}
+
+// writeLine overwrites the previous status line in place: it returns to
+// the start of the line, writes the new content, and pads with spaces to
+// erase any leftover tail from a longer previous line.
+func (m *Monitor) writeLine(line string) {
+	m.mu.Lock()
+	pad := ""
+	if len(line) < m.lastLineLen {
+		pad = strings.Repeat(" ", m.lastLineLen-len(line))
+	}
+	m.lastLineLen = len(line)
+	m.mu.Unlock()
+
+	fmt.Fprintf(m.out, "\r%s%s", line, pad)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// lineClearingWriter wraps a Monitor's output so that log messages never
+// collide with the self-overwriting status line: it blanks out whatever
+// status line is currently on screen before passing the write through.
+type lineClearingWriter struct {
+	m *Monitor
+}
+
+func (w *lineClearingWriter) Write(p []byte) (int, error) {
+	w.m.mu.Lock()
+	lineLen := w.m.lastLineLen
+	w.m.lastLineLen = 0
+	w.m.mu.Unlock()
+
+	if lineLen > 0 && !w.m.jsonMode {
+		fmt.Fprintf(w.m.out, "\r%s\r", strings.Repeat(" ", lineLen))
+	}
+	return w.m.out.Write(p)
+}
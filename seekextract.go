@@ -0,0 +1,301 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mfenniak/fast-archiver/progress"
+)
+
+// extractWorkerCount bounds how many goroutines concurrently call WriteAt
+// against the LRU handle cache during seekable extraction.
+const extractWorkerCount = 16
+
+// maxOpenExtractHandles bounds how many destination files the extractor
+// keeps open at once during seekable extraction. It is a soft cap: a
+// handle that is mid-write is never evicted, even if that temporarily
+// pushes the cache above capacity.
+const maxOpenExtractHandles = 128
+
+// writeJob is one out-of-order data block destined for a seekable
+// extraction worker.
+type writeJob struct {
+	path   string
+	offset uint64
+	data   []byte
+}
+
+// fileHandleCache is a small LRU of open, truncated *os.File handles keyed
+// by destination path, so that many interleaved files can be written
+// out-of-order with WriteAt without re-opening a handle for every block.
+type fileHandleCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	index    map[string]*list.Element
+}
+
+type cacheEntry struct {
+	path     string
+	file     *os.File
+	refCount int
+}
+
+func newFileHandleCache(capacity int) *fileHandleCache {
+	return &fileHandleCache{capacity: capacity, ll: list.New(), index: make(map[string]*list.Element)}
+}
+
+// open returns the cached handle for path, truncated to size and creating
+// it if this is the first time path has been seen. Every call increments a
+// refcount that acquireRef/release manage; the handle is only eligible for
+// LRU eviction, or final close, once that refcount reaches zero.
+func (c *fileHandleCache) open(path string, size int64) (*os.File, error) {
+	c.mu.Lock()
+	if el, ok := c.index[path]; ok {
+		c.ll.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cacheEntry).file, nil
+	}
+	c.mu.Unlock()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	c.mu.Lock()
+	el := c.ll.PushFront(&cacheEntry{path: path, file: file})
+	c.index[path] = el
+	c.evictLocked()
+	c.mu.Unlock()
+
+	return file, nil
+}
+
+func (c *fileHandleCache) acquireRef(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.index[path]; ok {
+		el.Value.(*cacheEntry).refCount++
+	}
+}
+
+func (c *fileHandleCache) release(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.index[path]
+	if !ok {
+		return
+	}
+	el.Value.(*cacheEntry).refCount--
+	c.evictLocked()
+}
+
+// evictLocked drops least-recently-used, idle handles until the cache is
+// back under capacity. It must be called with c.mu held.
+func (c *fileHandleCache) evictLocked() {
+	for c.ll.Len() > c.capacity {
+		el := c.ll.Back()
+		if el == nil || el.Value.(*cacheEntry).refCount > 0 {
+			break
+		}
+		c.ll.Remove(el)
+		entry := el.Value.(*cacheEntry)
+		delete(c.index, entry.path)
+		entry.file.Close()
+	}
+}
+
+// closeAndRemove force-closes and forgets path's handle regardless of its
+// refcount; used once a file's final block has been written.
+func (c *fileHandleCache) closeAndRemove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.index[path]
+	if !ok {
+		return
+	}
+	c.ll.Remove(el)
+	delete(c.index, path)
+	el.Value.(*cacheEntry).file.Close()
+}
+
+// seekableFileState tracks, per destination path, how many data blocks are
+// still in flight and whether the archive's endOfFileFlag has already been
+// seen (or the file was abandoned instead, see abandon), so the file can be
+// finalized exactly once: after the last outstanding block is flushed and
+// no earlier than endOfFileFlag/abandonment.
+type seekableFileState struct {
+	header    fileHeader
+	pending   int
+	ended     bool
+	abandoned bool
+}
+
+// seekableExtractor coordinates the worker pool, handle cache, and
+// per-path state used to extract a seekable-format archive with
+// out-of-order WriteAt calls instead of one goroutine per file.
+type seekableExtractor struct {
+	cache   *fileHandleCache
+	jobs    chan writeJob
+	workers sync.WaitGroup
+
+	mu     sync.Mutex
+	states map[string]*seekableFileState
+
+	workInProgress *sync.WaitGroup
+}
+
+func newSeekableExtractor(workInProgress *sync.WaitGroup) *seekableExtractor {
+	e := &seekableExtractor{
+		cache:          newFileHandleCache(maxOpenExtractHandles),
+		jobs:           make(chan writeJob, extractWorkerCount*4),
+		states:         make(map[string]*seekableFileState),
+		workInProgress: workInProgress,
+	}
+	e.workers.Add(extractWorkerCount)
+	for i := 0; i < extractWorkerCount; i++ {
+		go e.worker()
+	}
+	return e
+}
+
+func (e *seekableExtractor) worker() {
+	defer e.workers.Done()
+	for job := range e.jobs {
+		e.mu.Lock()
+		size := int64(e.states[job.path].header.size)
+		e.mu.Unlock()
+
+		// Pass the file's real size rather than 0: open() only uses it to
+		// Truncate a handle it has to newly create, which normally only
+		// happens once, in startFile. But a handle idle between blocks (no
+		// outstanding refs) is eligible for LRU eviction, and if that
+		// happens here, open() recreates it -- truncating to whatever size
+		// is given. A hardcoded 0 would silently zero out a file that had
+		// already been partially written.
+		file, err := e.cache.open(job.path, size)
+		if err != nil {
+			logger.Panicln("File open error:", err.Error())
+		}
+		if _, err := file.WriteAt(job.data, int64(job.offset)); err != nil {
+			logger.Panicln("File write error:", err.Error())
+		}
+		monitor.Update(progress.Update{BytesWritten: int64(len(job.data))})
+		e.cache.release(job.path)
+		e.finishBlock(job.path)
+	}
+}
+
+// startFile pre-creates and truncates path to its known size and registers
+// it for completion tracking. Called from the main archive-reading
+// goroutine when a seekable-format regular file's header is read.
+func (e *seekableExtractor) startFile(path string, header fileHeader) {
+	if verbose {
+		logger.Println(path)
+	}
+	monitor.Update(progress.Update{CurrentFile: path, BytesTotal: int64(header.size)})
+
+	dir, _ := filepath.Split(path)
+	if dir != "" {
+		if err := os.MkdirAll(dir, os.ModeDir|0755); err != nil {
+			logger.Panicln("Directory create error:", err.Error())
+		}
+	}
+
+	if _, err := e.cache.open(path, int64(header.size)); err != nil {
+		logger.Panicln("File create error:", err.Error())
+	}
+
+	e.mu.Lock()
+	e.states[path] = &seekableFileState{header: header}
+	e.mu.Unlock()
+
+	e.workInProgress.Add(1)
+}
+
+// submitBlock enqueues a data block for path to be written by a worker.
+func (e *seekableExtractor) submitBlock(path string, offset uint64, data []byte) {
+	e.mu.Lock()
+	e.states[path].pending++
+	e.mu.Unlock()
+
+	e.cache.acquireRef(path)
+	e.jobs <- writeJob{path: path, offset: offset, data: data}
+}
+
+func (e *seekableExtractor) finishBlock(path string) {
+	e.mu.Lock()
+	state := e.states[path]
+	state.pending--
+	done := state.pending == 0 && (state.ended || state.abandoned)
+	e.mu.Unlock()
+
+	if done {
+		e.finalize(path, state)
+	}
+}
+
+// endFile records that the archive's endOfFileFlag for path has been
+// reached; if every dispatched block has already been flushed this
+// finalizes the file immediately, otherwise the last finishBlock does.
+func (e *seekableExtractor) endFile(path string) {
+	e.mu.Lock()
+	state := e.states[path]
+	state.ended = true
+	done := state.pending == 0
+	e.mu.Unlock()
+
+	if done {
+		e.finalize(path, state)
+	}
+}
+
+// abandon marks path incomplete because -continue-on-error skipped a
+// corrupt chunk that may have carried its remaining data blocks or its
+// endOfFileFlag, which would otherwise leave it waiting on either forever.
+// Any blocks already dispatched before the skip are still written; the file
+// is finalized, with whatever data made it to disk, once they drain.
+func (e *seekableExtractor) abandon(path string) {
+	e.mu.Lock()
+	state, ok := e.states[path]
+	if !ok {
+		e.mu.Unlock()
+		return
+	}
+	state.abandoned = true
+	done := state.pending == 0
+	e.mu.Unlock()
+
+	if done {
+		e.finalize(path, state)
+	}
+}
+
+func (e *seekableExtractor) finalize(path string, state *seekableFileState) {
+	e.cache.closeAndRemove(path)
+	close(extractionDoneChan(path))
+	if !state.abandoned {
+		applyFileMetadata(path, state.header)
+		monitor.Update(progress.Update{FilesCompleted: 1})
+	}
+
+	e.mu.Lock()
+	delete(e.states, path)
+	e.mu.Unlock()
+
+	e.workInProgress.Done()
+}
+
+// wait closes the job queue and blocks until every worker has drained it.
+// Must only be called once the archive has been fully read.
+func (e *seekableExtractor) wait() {
+	close(e.jobs)
+	e.workers.Wait()
+}
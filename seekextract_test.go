@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestFileHandleCacheEvictionPreservesSize guards against a handle that is
+// evicted and later reopened silently truncating a file that was already
+// extended to its final size -- the bug worker() had when it always passed
+// size 0 to open() instead of the file's real size.
+func TestFileHandleCacheEvictionPreservesSize(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+
+	cache := newFileHandleCache(1) // capacity 1 forces eviction on the second path
+
+	fa, err := cache.open(a, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fa.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	cache.release(a) // refCount back to 0, making a's handle eligible for eviction
+
+	fb, err := cache.open(b, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.release(b)
+	_ = fb
+
+	// a's handle was evicted to make room for b; reopening it with its
+	// real size must not truncate the file back to empty.
+	fa2, err := cache.open(a, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := fa2.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 10 {
+		t.Fatalf("expected file to remain size 10 after reopen, got %d", info.Size())
+	}
+}
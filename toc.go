@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+)
+
+// tocEntry is one record in the table of contents appended as a trailer to
+// every archive: the archive path, the byte offset of its startOfFileFlag
+// record, and its total content size (from fileHeader.size). It lets -t
+// and -x locate a single file's header without scanning the archive from
+// the start.
+type tocEntry struct {
+	path         string
+	headerOffset uint64
+	totalBytes   uint64
+}
+
+// tocFooterMagic identifies the fixed-size footer written after the
+// serialized table of contents, distinguishing a proper trailer from a
+// truncated or corrupt one.
+var tocFooterMagic = [4]byte{'F', 'A', 'T', 'C'}
+
+const tocFooterSize = 4 + 4 + 4 + 4 // magic + indexOffset + indexLength + crc
+
+// countingWriter wraps an io.Writer and tracks the number of bytes written
+// through it, so archiveWriter can record each file's header offset as it
+// writes without requiring the underlying output to be seekable.
+type countingWriter struct {
+	w       io.Writer
+	written uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += uint64(n)
+	return n, err
+}
+
+// writeTOC serializes index and appends it to cw followed by the fixed
+// footer {magic, indexOffset, indexLength, crc}, so a seekable reader can
+// open the footer with a Seek from the end and read the whole index with
+// one more read instead of scanning every record.
+func writeTOC(cw *countingWriter, index []tocEntry) error {
+	var idx bytes.Buffer
+	if err := binary.Write(&idx, binary.BigEndian, uint32(len(index))); err != nil {
+		return err
+	}
+	for _, entry := range index {
+		if err := writeHeaderString(&idx, entry.path); err != nil {
+			return err
+		}
+		if err := binary.Write(&idx, binary.BigEndian, entry.headerOffset); err != nil {
+			return err
+		}
+		if err := binary.Write(&idx, binary.BigEndian, entry.totalBytes); err != nil {
+			return err
+		}
+	}
+
+	indexOffset := cw.written
+	indexLength := uint64(idx.Len())
+	// The footer's offset and length fields are uint32 (see tocFooterSize);
+	// silently truncating either on an archive that crossed 4GiB would
+	// write a footer that points at the wrong bytes instead of failing, and
+	// the corruption would only surface later as a confusing readTOC
+	// checksum mismatch. Refuse up front instead.
+	if indexOffset > math.MaxUint32 || indexLength > math.MaxUint32 {
+		return fmt.Errorf("archive too large for table of contents: offset %d or index length %d exceeds uint32", indexOffset, indexLength)
+	}
+
+	if _, err := cw.Write(idx.Bytes()); err != nil {
+		return err
+	}
+
+	if _, err := cw.Write(tocFooterMagic[:]); err != nil {
+		return err
+	}
+	if err := binary.Write(cw, binary.BigEndian, uint32(indexOffset)); err != nil {
+		return err
+	}
+	if err := binary.Write(cw, binary.BigEndian, uint32(indexLength)); err != nil {
+		return err
+	}
+	return binary.Write(cw, binary.BigEndian, crc32.ChecksumIEEE(idx.Bytes()))
+}
+
+// readTOC reads the table of contents trailer from a seekable file,
+// leaving the file position at indexOffset+indexLength (end of the
+// index, start of the footer) on success. It does not restore the file's
+// prior position; callers that need it saved it themselves first.
+func readTOC(file *os.File) ([]tocEntry, error) {
+	if _, err := file.Seek(-tocFooterSize, io.SeekEnd); err != nil {
+		return nil, err
+	}
+
+	var magic [4]byte
+	if _, err := io.ReadFull(file, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != tocFooterMagic {
+		return nil, fmt.Errorf("archive has no table of contents")
+	}
+
+	var indexOffset, indexLength, crc uint32
+	if err := binary.Read(file, binary.BigEndian, &indexOffset); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(file, binary.BigEndian, &indexLength); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(file, binary.BigEndian, &crc); err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(int64(indexOffset), io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, indexLength)
+	if _, err := io.ReadFull(file, buf); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(buf) != crc {
+		return nil, fmt.Errorf("table of contents checksum mismatch")
+	}
+
+	r := bytes.NewReader(buf)
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	index := make([]tocEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		path, err := readHeaderString(r)
+		if err != nil {
+			return nil, err
+		}
+		var entry tocEntry
+		entry.path = path
+		if err := binary.Read(r, binary.BigEndian, &entry.headerOffset); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &entry.totalBytes); err != nil {
+			return nil, err
+		}
+		index = append(index, entry)
+	}
+	return index, nil
+}
+
+// resolveHardlinkTargets expands selected, in place, to include the target
+// of every selected hardlink: it peeks each selected entry's header at its
+// TOC-recorded offset, and if that entry is a hardlink whose target isn't
+// already selected, adds the target and peeks it in turn, until nothing
+// new is found. It leaves seekFile's position unspecified; callers must
+// always reposition it afterward.
+func resolveHardlinkTargets(seekFile *os.File, index []tocEntry, selected map[string]bool) {
+	byPath := make(map[string]tocEntry, len(index))
+	for _, entry := range index {
+		byPath[entry.path] = entry
+	}
+
+	queue := make([]string, 0, len(selected))
+	for path := range selected {
+		queue = append(queue, path)
+	}
+
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+
+		entry, ok := byPath[path]
+		if !ok {
+			continue
+		}
+		if _, err := seekFile.Seek(int64(entry.headerOffset), io.SeekStart); err != nil {
+			continue
+		}
+
+		var pathSize uint16
+		if err := binary.Read(seekFile, binary.BigEndian, &pathSize); err != nil {
+			continue
+		}
+		if _, err := io.CopyN(io.Discard, seekFile, int64(pathSize)); err != nil {
+			continue
+		}
+		flagByte := make([]byte, 1)
+		if _, err := io.ReadFull(seekFile, flagByte); err != nil || flagByte[0] != startOfFileFlag {
+			continue
+		}
+		header, err := readFileHeader(seekFile)
+		if err != nil {
+			continue
+		}
+
+		if header.hardlinkTarget != "" && !selected[header.hardlinkTarget] {
+			selected[header.hardlinkTarget] = true
+			queue = append(queue, header.hardlinkTarget)
+		}
+	}
+}
+
+// minHeaderOffset reports the smallest headerOffset among index entries
+// whose path is in selected, used to skip the leading portion of the
+// archive that precedes every requested file.
+func minHeaderOffset(index []tocEntry, selected map[string]bool) (uint64, bool) {
+	var min uint64
+	found := false
+	for _, entry := range index {
+		if !selected[entry.path] {
+			continue
+		}
+		if !found || entry.headerOffset < min {
+			min = entry.headerOffset
+			found = true
+		}
+	}
+	return min, found
+}
+
+// listArchive prints the path of every archived file in in, or only those
+// in selected if it is non-empty. When in.seekFile is set (a plain,
+// un-wrapped archive on a seekable regular file) and has a valid table of
+// contents, the index alone is enough and the rest of the archive is never
+// read; otherwise (a pipe, a compressed or chunk-framed archive, or a
+// corrupt trailer) it falls back to scanning every record.
+func listArchive(in archiveInput, selected []string) {
+	var selectedSet map[string]bool
+	if len(selected) > 0 {
+		selectedSet = make(map[string]bool, len(selected))
+		for _, path := range selected {
+			selectedSet[path] = true
+		}
+	}
+
+	if in.seekFile != nil {
+		if index, err := readTOC(in.seekFile); err == nil {
+			for _, entry := range index {
+				if selectedSet == nil || selectedSet[entry.path] {
+					fmt.Println(entry.path)
+				}
+			}
+			return
+		}
+	}
+
+	listArchiveStreaming(in.r, selectedSet, in.chunkSkipCount)
+}
+
+// listArchiveStreaming scans the archive from the current position in file
+// one record at a time, printing the path of each startOfFileFlag record
+// and discarding everything else. It is the fallback used when the input
+// cannot be seeked (e.g. a pipe), or is wrapped in compression or chunk
+// framing, mirroring the block-decoding loop in archiveReader but without
+// ever writing to disk. chunkSkipCount is threaded through from in so the
+// header read below can tell a genuine read error from -continue-on-error
+// having skipped the chunk the header itself lived in.
+func listArchiveStreaming(file io.Reader, selectedSet map[string]bool, chunkSkipCount func() int) {
+	formatFlags := readArchiveHeader(file, chunkSkipCount)
+	seekable := formatFlags&formatFlagSeekable != 0
+
+	for {
+		var pathSize uint16
+		err := binary.Read(file, binary.BigEndian, &pathSize)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			logger.Panicln("Archive read error:", err.Error())
+		}
+
+		buf := make([]byte, pathSize)
+		if _, err := io.ReadFull(file, buf); err != nil {
+			logger.Panicln("Archive read error:", err.Error())
+		}
+		filePath := string(buf)
+
+		flag := make([]byte, 1)
+		if _, err := io.ReadFull(file, flag); err != nil {
+			logger.Panicln("Archive read error:", err.Error())
+		}
+
+		switch {
+		case flag[0] == endOfArchiveFlag:
+			return
+		case flag[0] == startOfFileFlag:
+			if _, err := readFileHeader(file); err != nil {
+				logger.Panicln("Archive read error:", err.Error())
+			}
+			if selectedSet == nil || selectedSet[filePath] {
+				fmt.Println(filePath)
+			}
+		case flag[0] == endOfFileFlag:
+			// nothing to read
+		case flag[0] == dataBlockFlag || flag[0] == blockDefFlag || flag[0] == blockRefFlag:
+			if seekable {
+				var offset uint64
+				if err := binary.Read(file, binary.BigEndian, &offset); err != nil {
+					logger.Panicln("Archive read error:", err.Error())
+				}
+			}
+			if flag[0] == blockRefFlag {
+				var hash blockHash
+				if _, err := io.ReadFull(file, hash[:]); err != nil {
+					logger.Panicln("Archive read error:", err.Error())
+				}
+				continue
+			}
+			if flag[0] == blockDefFlag {
+				var hash blockHash
+				if _, err := io.ReadFull(file, hash[:]); err != nil {
+					logger.Panicln("Archive read error:", err.Error())
+				}
+			}
+			var blockSize uint16
+			if err := binary.Read(file, binary.BigEndian, &blockSize); err != nil {
+				logger.Panicln("Archive read error:", err.Error())
+			}
+			if _, err := io.CopyN(io.Discard, file, int64(blockSize)); err != nil {
+				logger.Panicln("Archive read error:", err.Error())
+			}
+		default:
+			logger.Panicln("Archive error: unrecognized block flag", flag[0])
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteTOCRejectsOversizedOffset guards against silently truncating a
+// uint64 byte offset into the footer's uint32 field on an archive too large
+// to represent faithfully.
+func TestWriteTOCRejectsOversizedOffset(t *testing.T) {
+	cw := &countingWriter{w: io.Discard, written: uint64(1) << 33} // past uint32 range
+	err := writeTOC(cw, []tocEntry{{path: "a", headerOffset: 0, totalBytes: 1}})
+	if err == nil {
+		t.Fatal("expected writeTOC to reject an indexOffset past uint32 range, got nil error")
+	}
+}
+
+func TestWriteReadTOCRoundTrip(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "toc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cw := &countingWriter{w: f}
+	index := []tocEntry{
+		{path: "a.txt", headerOffset: 0, totalBytes: 10},
+		{path: "b.txt", headerOffset: 50, totalBytes: 20},
+	}
+	if err := writeTOC(cw, index); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readTOC(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(index) {
+		t.Fatalf("expected %d entries, got %d", len(index), len(got))
+	}
+	for i := range index {
+		if got[i] != index[i] {
+			t.Fatalf("entry %d: expected %+v, got %+v", i, index[i], got[i])
+		}
+	}
+}